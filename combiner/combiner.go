@@ -0,0 +1,506 @@
+// Package combiner implements the core image-tinting-and-compositing logic
+// behind the image_combiner command: given a list of layers, each an image
+// paired with a tint color and a blend mode, it produces a single combined
+// image. It does no file or network I/O of its own, so it can be embedded in
+// servers, batch pipelines, or GUI tools.
+package combiner
+
+import (
+	"fmt"
+	"golang.org/x/image/colornames"
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Implements the color interface, but uses floating-point colors for easier
+// multiplication.
+type floatColor struct {
+	r float32
+	g float32
+	b float32
+}
+
+func (c floatColor) Add(toAdd color.Color) floatColor {
+	converted := convertToFloatColor(toAdd)
+	return floatColor{
+		r: c.r + converted.r,
+		g: c.g + converted.g,
+		b: c.b + converted.b,
+	}
+}
+
+func (c floatColor) Multiply(scale color.Color) floatColor {
+	converted := convertToFloatColor(scale)
+	return floatColor{
+		r: c.r * converted.r,
+		g: c.g * converted.g,
+		b: c.b * converted.b,
+	}
+}
+
+func (c floatColor) Scale(scale float32) floatColor {
+	return floatColor{
+		r: c.r * scale,
+		g: c.g * scale,
+		b: c.b * scale,
+	}
+}
+
+func (c floatColor) RGBA() (r, g, b, a uint32) {
+	var red, green, blue uint32
+	if c.r >= 1.0 {
+		red = 0xffff
+	} else {
+		red = uint32(c.r * float32(0xffff))
+	}
+	if c.g >= 1.0 {
+		green = 0xffff
+	} else {
+		green = uint32(c.g * float32(0xffff))
+	}
+	if c.b >= 1.0 {
+		blue = 0xffff
+	} else {
+		blue = uint32(c.b * float32(0xffff))
+	}
+	return red, green, blue, 0xffff
+}
+
+func (c floatColor) String() string {
+	return fmt.Sprintf("%04x%04x%04x", uint16(c.r*0xffff), uint16(c.g*0xffff),
+		uint16(c.b*0xffff))
+}
+
+func convertToFloatColor(c color.Color) floatColor {
+	tryResult, ok := c.(floatColor)
+	if ok {
+		return tryResult
+	}
+	r, g, b, _ := c.RGBA()
+	return floatColor{
+		r: float32(r) / 0xffff,
+		g: float32(g) / 0xffff,
+		b: float32(b) / 0xffff,
+	}
+}
+
+type floatColorImage struct {
+	pixels []floatColor
+	w, h   int
+}
+
+func (f *floatColorImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, f.w, f.h)
+}
+
+func (f *floatColorImage) ColorModel() color.Model {
+	return color.ModelFunc(func(c color.Color) color.Color {
+		return convertToFloatColor(c)
+	})
+}
+
+func (f *floatColorImage) At(x, y int) color.Color {
+	if (x < 0) || (y < 0) || (x >= f.w) || (y >= f.h) {
+		return color.Black
+	}
+	return f.pixels[(y*f.w)+x]
+}
+
+// Combines the pixel at (x, y) with tint using blender, given the source
+// pixel's brightness.
+func (f *floatColorImage) BlendPixel(x, y int, tint floatColor,
+	brightness float32, blender Blender) {
+	if (x < 0) || (y < 0) || (x >= f.w) || (y >= f.h) {
+		return
+	}
+	idx := (y * f.w) + x
+	f.pixels[idx] = blender.Blend(f.pixels[idx], tint, brightness)
+}
+
+func newFloatColorImage(w, h int) (*floatColorImage, error) {
+	if (w <= 0) || (h <= 0) {
+		return nil, fmt.Errorf("Image bounds must be positive")
+	}
+	return &floatColorImage{
+		w:      w,
+		h:      h,
+		pixels: make([]floatColor, w*h),
+	}, nil
+}
+
+func parse24BitColor(value string) (floatColor, error) {
+	parsed, e := strconv.ParseUint(value, 16, 32)
+	if e != nil {
+		return floatColor{}, fmt.Errorf("Couldn't parse color %s: %s", value,
+			e)
+	}
+	return floatColor{
+		r: float32((parsed>>16)&0xff) / 255.0,
+		g: float32((parsed>>8)&0xff) / 255.0,
+		b: float32(parsed&0xff) / 255.0,
+	}, nil
+}
+
+func parse48BitColor(value string) (floatColor, error) {
+	parsed, e := strconv.ParseUint(value, 16, 64)
+	if e != nil {
+		return floatColor{}, fmt.Errorf("Couldn't parse color %s: %s", value,
+			e)
+	}
+	return floatColor{
+		r: float32((parsed>>32)&0xffff) / 65535.0,
+		g: float32((parsed>>16)&0xffff) / 65535.0,
+		b: float32(parsed&0xffff) / 65535.0,
+	}, nil
+}
+
+// Attempts to parse a color using an SVG color name. Returns false if a color
+// with the given name wasn't found.
+func parseNamedColor(name string) (floatColor, bool) {
+	name = strings.ToLower(name)
+	namedColor := colornames.Map[name]
+	// Since a map returns a zero-value if the key doesn't exist, and no
+	// visible will have a zero alpha value, we use an alpha value of zero to
+	// detect that the given name wasn't in the colornames map.
+	_, _, _, a := namedColor.RGBA()
+	if a == 0 {
+		return convertToFloatColor(namedColor), false
+	}
+	return convertToFloatColor(namedColor), true
+}
+
+// Parses an input hex string with either 24-bit or 48-bit RGB color as a
+// float color. Returns an error if the input value is invalid.
+func parseFloatColor(value string) (floatColor, error) {
+	// First check if a named color was given.
+	namedColor, nameOK := parseNamedColor(value)
+	if nameOK {
+		return namedColor, nil
+	}
+	// Allow hex color values starting with a single '#'
+	value = strings.TrimPrefix(value, "#")
+	if len(value) == 6 {
+		return parse24BitColor(value)
+	}
+	if len(value) == 12 {
+		return parse48BitColor(value)
+	}
+	return floatColor{}, fmt.Errorf("Need a 24- or 48-bit RGB color, got %s",
+		value)
+}
+
+// ParseColor parses a color.Color from an SVG color name, 6 hex digits, or
+// 12 hex digits (for 48-bit color), optionally prefixed with "#".
+func ParseColor(value string) (color.Color, error) {
+	return parseFloatColor(value)
+}
+
+// BlendMode selects how a layer's tinted pixels are combined with the
+// pixels already present in the destination image.
+type BlendMode int
+
+const (
+	// Scales the tint by the source pixel's brightness and adds it to the
+	// destination. This is the combiner's original, and still default,
+	// behavior.
+	BlendAdd BlendMode = iota
+	// The "screen" mode: inverts both colors, multiplies them, then
+	// inverts the result. Always lightens the destination.
+	BlendScreen
+	// Multiplies the destination by the tint, interpolated towards white
+	// as the source pixel's brightness drops towards zero. Always
+	// darkens the destination.
+	BlendMultiply
+	// Takes the per-channel maximum of the destination and the tint
+	// scaled by brightness.
+	BlendLighten
+	// Takes the per-channel minimum of the destination and the tint,
+	// interpolated towards white as brightness drops towards zero.
+	BlendDarken
+	// Porter-Duff "over": linearly interpolates from the destination to
+	// the tint, using the source pixel's brightness as coverage.
+	BlendOver
+)
+
+// ParseBlendMode parses a blend mode name ("add", "screen", "multiply",
+// "lighten" (or "max"), "darken" (or "min"), or "over"). Returns an error if
+// name isn't a recognized mode.
+func ParseBlendMode(name string) (BlendMode, error) {
+	switch strings.ToLower(name) {
+	case "add":
+		return BlendAdd, nil
+	case "screen":
+		return BlendScreen, nil
+	case "multiply":
+		return BlendMultiply, nil
+	case "lighten", "max":
+		return BlendLighten, nil
+	case "darken", "min":
+		return BlendDarken, nil
+	case "over":
+		return BlendOver, nil
+	}
+	return BlendAdd, fmt.Errorf("Unknown blend mode %q; must be one of "+
+		"\"add\", \"screen\", \"multiply\", \"lighten\", \"darken\", or "+
+		"\"over\"", name)
+}
+
+// Linearly interpolates between two colors; t is clamped to neither end, so
+// callers are expected to pass a value already in [0, 1].
+func lerpColor(a, b floatColor, t float32) floatColor {
+	return floatColor{
+		r: a.r + (b.r-a.r)*t,
+		g: a.g + (b.g-a.g)*t,
+		b: a.b + (b.b-a.b)*t,
+	}
+}
+
+func maxFloat32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minFloat32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Blender combines a destination pixel with a layer's tint color, given the
+// corresponding source pixel's brightness (in [0, 1]) as coverage.
+type Blender interface {
+	Blend(dest, tint floatColor, brightness float32) floatColor
+}
+
+type addBlender struct{}
+
+func (addBlender) Blend(dest, tint floatColor, brightness float32) floatColor {
+	return dest.Add(tint.Scale(brightness))
+}
+
+type screenBlender struct{}
+
+func (screenBlender) Blend(dest, tint floatColor,
+	brightness float32) floatColor {
+	s := tint.Scale(brightness)
+	return floatColor{
+		r: 1 - (1-dest.r)*(1-s.r),
+		g: 1 - (1-dest.g)*(1-s.g),
+		b: 1 - (1-dest.b)*(1-s.b),
+	}
+}
+
+type multiplyBlender struct{}
+
+func (multiplyBlender) Blend(dest, tint floatColor,
+	brightness float32) floatColor {
+	s := lerpColor(floatColor{r: 1, g: 1, b: 1}, tint, brightness)
+	return floatColor{
+		r: dest.r * s.r,
+		g: dest.g * s.g,
+		b: dest.b * s.b,
+	}
+}
+
+type lightenBlender struct{}
+
+func (lightenBlender) Blend(dest, tint floatColor,
+	brightness float32) floatColor {
+	s := tint.Scale(brightness)
+	return floatColor{
+		r: maxFloat32(dest.r, s.r),
+		g: maxFloat32(dest.g, s.g),
+		b: maxFloat32(dest.b, s.b),
+	}
+}
+
+type darkenBlender struct{}
+
+func (darkenBlender) Blend(dest, tint floatColor,
+	brightness float32) floatColor {
+	s := lerpColor(floatColor{r: 1, g: 1, b: 1}, tint, brightness)
+	return floatColor{
+		r: minFloat32(dest.r, s.r),
+		g: minFloat32(dest.g, s.g),
+		b: minFloat32(dest.b, s.b),
+	}
+}
+
+type overBlender struct{}
+
+func (overBlender) Blend(dest, tint floatColor,
+	brightness float32) floatColor {
+	return lerpColor(dest, tint, brightness)
+}
+
+// Returns the Blender implementing the given mode.
+func blenderFor(mode BlendMode) Blender {
+	switch mode {
+	case BlendScreen:
+		return screenBlender{}
+	case BlendMultiply:
+		return multiplyBlender{}
+	case BlendLighten:
+		return lightenBlender{}
+	case BlendDarken:
+		return darkenBlender{}
+	case BlendOver:
+		return overBlender{}
+	default:
+		return addBlender{}
+	}
+}
+
+// LuminanceMode specifies which formula convertToBrightness uses to reduce
+// an RGB color to a single brightness value.
+type LuminanceMode int
+
+const (
+	// Averages the three channels. Fast, but doesn't reflect how humans
+	// actually perceive brightness; e.g. blue looks darker than green at
+	// the same magnitude.
+	LuminanceAverage LuminanceMode = iota
+	// The WCAG 2.1 definition of relative luminance: linearize each sRGB
+	// channel, then take a perceptually-weighted sum favoring green.
+	LuminanceWCAG
+	// The Rec. 709 luma coefficients, as used for HD video.
+	LuminanceRec709
+)
+
+// ParseLuminanceMode parses a luminance mode name ("average", "wcag", or
+// "rec709"). Returns an error if the string doesn't match one of them.
+func ParseLuminanceMode(value string) (LuminanceMode, error) {
+	switch strings.ToLower(value) {
+	case "average":
+		return LuminanceAverage, nil
+	case "wcag":
+		return LuminanceWCAG, nil
+	case "rec709":
+		return LuminanceRec709, nil
+	}
+	return LuminanceAverage, fmt.Errorf("Unknown luminance mode %q; must be "+
+		"one of \"average\", \"wcag\", or \"rec709\"", value)
+}
+
+// Used by the WCAG relative luminance formula to linearize a single sRGB
+// channel value in the range [0, 1].
+func linearizeSRGBChannel(c float32) float32 {
+	if c <= 0.03928 {
+		return c / 12.92
+	}
+	return float32(math.Pow(float64((c+0.055)/1.055), 2.4))
+}
+
+// Converts a given arbitrary RGB color to a single brightness value, using
+// the given mode to decide how the channels are weighted.
+func convertToBrightness(c color.Color, mode LuminanceMode) float32 {
+	r, g, b, _ := c.RGBA()
+	rf := float32(r) / 65535.0
+	gf := float32(g) / 65535.0
+	bf := float32(b) / 65535.0
+	switch mode {
+	case LuminanceWCAG:
+		rLin := linearizeSRGBChannel(rf)
+		gLin := linearizeSRGBChannel(gf)
+		bLin := linearizeSRGBChannel(bf)
+		return 0.2126*rLin + 0.7152*gLin + 0.0722*bLin
+	case LuminanceRec709:
+		return 0.2126*rf + 0.7152*gf + 0.0722*bf
+	default:
+		return (rf + gf + bf) / 3.0
+	}
+}
+
+// The number of rows of dest assigned to a single worker-pool job in
+// addColor. Since each job only ever touches its own disjoint rows of dest,
+// strips can safely run concurrently even though Blend isn't commutative.
+const compositeStripHeight = 64
+
+// Composites pic into dest using tint and blend, splitting the work into
+// horizontal strips processed by a runtime.NumCPU()-sized worker pool.
+func addColor(dest *floatColorImage, pic image.Image, tint floatColor,
+	luminance LuminanceMode, blend BlendMode) {
+	blender := blenderFor(blend)
+	w := pic.Bounds().Dx()
+	h := pic.Bounds().Dy()
+	type strip struct{ startY, endY int }
+	jobs := make(chan strip)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var scale float32
+			for job := range jobs {
+				for y := job.startY; y < job.endY; y++ {
+					for x := 0; x < w; x++ {
+						scale = convertToBrightness(pic.At(x, y), luminance)
+						dest.BlendPixel(x, y, tint, scale, blender)
+					}
+				}
+			}
+		}()
+	}
+	for y := 0; y < h; y += compositeStripHeight {
+		endY := y + compositeStripHeight
+		if endY > h {
+			endY = h
+		}
+		jobs <- strip{y, endY}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Layer is a single image to be tinted and composited, paired with the tint
+// color and blend mode to combine it with the other layers.
+type Layer struct {
+	Image image.Image
+	Tint  color.Color
+	Mode  BlendMode
+}
+
+// Options controls how Combine composites its layers.
+type Options struct {
+	// Selects the formula used to convert each layer's pixels to a
+	// brightness value. The zero value is LuminanceAverage.
+	Luminance LuminanceMode
+}
+
+// Combine composites the given layers into a single image, in order: each
+// layer's pixels are reduced to a brightness (as determined by
+// opts.Luminance), which weights the layer's Tint as it is blended into the
+// destination using the layer's Mode.
+// The destination is sized to the maximum width and height of all layers.
+func Combine(layers []Layer, opts Options) (image.Image, error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("At least one layer must be provided")
+	}
+	var w, h int
+	for _, layer := range layers {
+		bounds := layer.Image.Bounds()
+		if bounds.Dx() > w {
+			w = bounds.Dx()
+		}
+		if bounds.Dy() > h {
+			h = bounds.Dy()
+		}
+	}
+	dest, e := newFloatColorImage(w, h)
+	if e != nil {
+		return nil, fmt.Errorf("Failed creating combined image: %s", e)
+	}
+	for _, layer := range layers {
+		tint := convertToFloatColor(layer.Tint)
+		addColor(dest, layer.Image, tint, opts.Luminance, layer.Mode)
+	}
+	return dest, nil
+}
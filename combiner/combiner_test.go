@@ -0,0 +1,245 @@
+package combiner
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"named", "red", false},
+		{"named case insensitive", "Blue", false},
+		{"24-bit hex", "ff8000", false},
+		{"24-bit hex with hash", "#ff8000", false},
+		{"48-bit hex", "ffff80000000", false},
+		{"invalid length", "ff80", true},
+		{"invalid hex digits", "zzzzzz", true},
+		{"unknown name", "not-a-color", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, e := ParseColor(tc.value)
+			if tc.wantErr && e == nil {
+				t.Fatalf("ParseColor(%q): expected an error, got nil", tc.value)
+			}
+			if !tc.wantErr && e != nil {
+				t.Fatalf("ParseColor(%q): unexpected error: %s", tc.value, e)
+			}
+		})
+	}
+}
+
+func TestParseBlendMode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    BlendMode
+		wantErr bool
+	}{
+		{"add", BlendAdd, false},
+		{"screen", BlendScreen, false},
+		{"multiply", BlendMultiply, false},
+		{"lighten", BlendLighten, false},
+		{"max", BlendLighten, false},
+		{"darken", BlendDarken, false},
+		{"min", BlendDarken, false},
+		{"over", BlendOver, false},
+		{"OVER", BlendOver, false},
+		{"bogus", 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			got, e := ParseBlendMode(tc.value)
+			if tc.wantErr {
+				if e == nil {
+					t.Fatalf("ParseBlendMode(%q): expected an error, got nil",
+						tc.value)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("ParseBlendMode(%q): unexpected error: %s", tc.value,
+					e)
+			}
+			if got != tc.want {
+				t.Fatalf("ParseBlendMode(%q) = %v, want %v", tc.value, got,
+					tc.want)
+			}
+		})
+	}
+}
+
+func TestParseLuminanceMode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    LuminanceMode
+		wantErr bool
+	}{
+		{"average", LuminanceAverage, false},
+		{"wcag", LuminanceWCAG, false},
+		{"rec709", LuminanceRec709, false},
+		{"REC709", LuminanceRec709, false},
+		{"bogus", 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			got, e := ParseLuminanceMode(tc.value)
+			if tc.wantErr {
+				if e == nil {
+					t.Fatalf("ParseLuminanceMode(%q): expected an error, "+
+						"got nil", tc.value)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("ParseLuminanceMode(%q): unexpected error: %s",
+					tc.value, e)
+			}
+			if got != tc.want {
+				t.Fatalf("ParseLuminanceMode(%q) = %v, want %v", tc.value,
+					got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConvertToBrightnessWCAGCoefficients(t *testing.T) {
+	// White should be fully bright, and black fully dark, under every
+	// luminance mode; this mostly guards against a mistyped coefficient
+	// silently making a previously-broken case "work" by coincidence.
+	for _, mode := range []LuminanceMode{LuminanceAverage, LuminanceWCAG,
+		LuminanceRec709} {
+		if b := convertToBrightness(color.White, mode); b < 0.999 {
+			t.Errorf("mode %v: white brightness = %f, want ~1.0", mode, b)
+		}
+		if b := convertToBrightness(color.Black, mode); b > 0.001 {
+			t.Errorf("mode %v: black brightness = %f, want ~0.0", mode, b)
+		}
+	}
+	// Pure blue should be dimmer than pure green under both WCAG and
+	// Rec. 709, since both weight blue far below green.
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	green := color.RGBA{G: 0xff, A: 0xff}
+	for _, mode := range []LuminanceMode{LuminanceWCAG, LuminanceRec709} {
+		blueBrightness := convertToBrightness(blue, mode)
+		greenBrightness := convertToBrightness(green, mode)
+		if blueBrightness >= greenBrightness {
+			t.Errorf("mode %v: blue brightness %f not less than green "+
+				"brightness %f", mode, blueBrightness, greenBrightness)
+		}
+	}
+}
+
+func TestBlenders(t *testing.T) {
+	dest := floatColor{r: 0.5, g: 0.5, b: 0.5}
+	white := floatColor{r: 1, g: 1, b: 1}
+
+	tests := []struct {
+		name       string
+		blender    Blender
+		brightness float32
+		want       floatColor
+	}{
+		{"add zero brightness", addBlender{}, 0, dest},
+		{"add full brightness", addBlender{}, 1, floatColor{r: 1.5, g: 1.5,
+			b: 1.5}},
+		{"screen zero brightness leaves dest", screenBlender{}, 0, dest},
+		{"screen full brightness with white tint is white", screenBlender{},
+			1, white},
+		{"multiply zero brightness leaves dest", multiplyBlender{}, 0, dest},
+		{"multiply full brightness with white tint leaves dest",
+			multiplyBlender{}, 1, dest},
+		{"lighten zero brightness leaves dest", lightenBlender{}, 0, dest},
+		{"lighten full brightness with white tint is white",
+			lightenBlender{}, 1, white},
+		{"darken zero brightness leaves dest", darkenBlender{}, 0, dest},
+		{"darken full brightness with white tint leaves dest",
+			darkenBlender{}, 1, dest},
+		{"over zero brightness leaves dest", overBlender{}, 0, dest},
+		{"over full brightness with white tint is white", overBlender{}, 1,
+			white},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.blender.Blend(dest, white, tc.brightness)
+			if got != tc.want {
+				t.Fatalf("Blend(%v, white, %v) = %v, want %v", dest,
+					tc.brightness, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBlenderFor(t *testing.T) {
+	tests := []struct {
+		mode BlendMode
+		want Blender
+	}{
+		{BlendAdd, addBlender{}},
+		{BlendScreen, screenBlender{}},
+		{BlendMultiply, multiplyBlender{}},
+		{BlendLighten, lightenBlender{}},
+		{BlendDarken, darkenBlender{}},
+		{BlendOver, overBlender{}},
+	}
+	for _, tc := range tests {
+		if got := blenderFor(tc.mode); got != tc.want {
+			t.Errorf("blenderFor(%v) = %T, want %T", tc.mode, got, tc.want)
+		}
+	}
+}
+
+// solidImage is a minimal image.Image returning the same color everywhere
+// within its bounds, used to exercise Combine without needing real decoded
+// image fixtures.
+type solidImage struct {
+	bounds image.Rectangle
+	c      color.Color
+}
+
+func (s *solidImage) ColorModel() color.Model { return color.RGBAModel }
+func (s *solidImage) Bounds() image.Rectangle { return s.bounds }
+func (s *solidImage) At(x, y int) color.Color { return s.c }
+
+func TestCombineRequiresLayers(t *testing.T) {
+	_, e := Combine(nil, Options{})
+	if e == nil {
+		t.Fatal("Combine with no layers: expected an error, got nil")
+	}
+}
+
+func TestCombineSizesToLargestLayer(t *testing.T) {
+	small := &solidImage{bounds: image.Rect(0, 0, 2, 2), c: color.White}
+	large := &solidImage{bounds: image.Rect(0, 0, 4, 3), c: color.White}
+	layers := []Layer{
+		{Image: small, Tint: color.White, Mode: BlendAdd},
+		{Image: large, Tint: color.White, Mode: BlendAdd},
+	}
+	result, e := Combine(layers, Options{})
+	if e != nil {
+		t.Fatalf("Combine: unexpected error: %s", e)
+	}
+	bounds := result.Bounds()
+	if bounds.Dx() != 4 || bounds.Dy() != 3 {
+		t.Fatalf("Combine result bounds = %v, want 4x3", bounds)
+	}
+}
+
+func TestCombineAddsWhiteLayersToWhite(t *testing.T) {
+	white := &solidImage{bounds: image.Rect(0, 0, 2, 2), c: color.White}
+	layers := []Layer{
+		{Image: white, Tint: color.White, Mode: BlendAdd},
+	}
+	result, e := Combine(layers, Options{})
+	if e != nil {
+		t.Fatalf("Combine: unexpected error: %s", e)
+	}
+	r, g, b, _ := result.At(0, 0).RGBA()
+	if r < 0xfffe || g < 0xfffe || b < 0xfffe {
+		t.Fatalf("Combine result pixel = (%d, %d, %d), want ~white", r, g, b)
+	}
+}
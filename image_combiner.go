@@ -1,332 +1,580 @@
 // The image combiner program takes multiple images and an associated color for
 // each. It multiplies the overall brightness for each pixel in each input
 // image by the corresponding color for that image. All such colored pixels are
-// added together in the output image.
+// added together in the output image, unless another blend mode is given for
+// that image's color. The combining logic itself lives in the
+// combiner package; this file is a thin CLI wrapper around it.
 package main
 
 import (
 	"fmt"
-	_ "github.com/spakin/netpbm"
+	"github.com/spakin/netpbm"
+	"github.com/yalue/image_combiner/combiner"
 	_ "golang.org/x/image/bmp"
-	"golang.org/x/image/colornames"
 	"image"
 	"image/color"
-	_ "image/gif"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
-	_ "image/png"
+	"image/png"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-// Implements the color interface, but uses floating-point colors for easier
-// multiplication.
-type floatColor struct {
-	r float32
-	g float32
-	b float32
+// Parses a "<color>" or "<color>:<mode>" argument, as accepted for each
+// input image's color on the command line. The mode, if given, selects one
+// of the combiner.BlendMode values; it defaults to combiner.BlendAdd.
+func parseColorSpec(value string) (color.Color, combiner.BlendMode, error) {
+	mode := combiner.BlendAdd
+	colorStr := value
+	if idx := strings.LastIndex(value, ":"); idx >= 0 {
+		parsedMode, e := combiner.ParseBlendMode(value[idx+1:])
+		if e != nil {
+			return nil, mode, e
+		}
+		mode = parsedMode
+		colorStr = value[:idx]
+	}
+	parsedColor, e := combiner.ParseColor(colorStr)
+	if e != nil {
+		return nil, mode, e
+	}
+	return parsedColor, mode, nil
 }
 
-func (c floatColor) Add(toAdd color.Color) floatColor {
-	converted := convertToFloatColor(toAdd)
-	return floatColor{
-		r: c.r + converted.r,
-		g: c.g + converted.g,
-		b: c.b + converted.b,
-	}
+// This contains a filename, parsed color value, and blend mode, parsed from
+// the command line arguments.
+type imageInput struct {
+	filename   string
+	colorValue color.Color
+	blendMode  combiner.BlendMode
 }
 
-func (c floatColor) Multiply(scale color.Color) floatColor {
-	converted := convertToFloatColor(scale)
-	return floatColor{
-		r: c.r * converted.r,
-		g: c.g * converted.g,
-		b: c.b * converted.b,
+// Opens and decodes a single image file. Broken out so it can be run
+// concurrently across multiple input files.
+func decodeImageFile(filename string) (image.Image, error) {
+	f, e := os.Open(filename)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s: %s", filename, e)
+	}
+	defer f.Close()
+	pic, _, e := image.Decode(f)
+	if e != nil {
+		return nil, fmt.Errorf("Failed decoding %s: %s", filename, e)
 	}
+	return pic, nil
 }
 
-func (c floatColor) Scale(scale float32) floatColor {
-	return floatColor{
-		r: c.r * scale,
-		g: c.g * scale,
-		b: c.b * scale,
+// Decodes every input file concurrently, since each os.Open + image.Decode
+// is otherwise independent I/O- and CPU-bound work. Returns the decoded
+// images in the same order as imageFiles.
+func decodeImageFiles(imageFiles []imageInput) ([]image.Image, error) {
+	pics := make([]image.Image, len(imageFiles))
+	errs := make([]error, len(imageFiles))
+	var wg sync.WaitGroup
+	for i, imageFile := range imageFiles {
+		wg.Add(1)
+		go func(i int, filename string) {
+			defer wg.Done()
+			pics[i], errs[i] = decodeImageFile(filename)
+		}(i, imageFile.filename)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return nil, e
+		}
 	}
+	return pics, nil
 }
 
-func (c floatColor) RGBA() (r, g, b, a uint32) {
-	var red, green, blue uint32
-	if c.r >= 1.0 {
-		red = 0xffff
-	} else {
-		red = uint32(c.r * float32(0xffff))
-	}
-	if c.g >= 1.0 {
-		green = 0xffff
-	} else {
-		green = uint32(c.g * float32(0xffff))
-	}
-	if c.b >= 1.0 {
-		blue = 0xffff
-	} else {
-		blue = uint32(c.b * float32(0xffff))
-	}
-	return red, green, blue, 0xffff
+// Returns the maximum dimensions across a list of already-decoded images.
+func getMaxDimensions(pics []image.Image) (int, int) {
+	var maxW, maxH int
+	for _, pic := range pics {
+		if pic.Bounds().Dx() > maxW {
+			maxW = pic.Bounds().Dx()
+		}
+		if pic.Bounds().Dy() > maxH {
+			maxH = pic.Bounds().Dy()
+		}
+	}
+	return maxW, maxH
 }
 
-func (c floatColor) String() string {
-	return fmt.Sprintf("%04x%04x%04x", uint16(c.r*0xffff), uint16(c.g*0xffff),
-		uint16(c.b*0xffff))
+// Builds the combiner.Layer list for a set of already-decoded images.
+func buildLayers(imageFiles []imageInput, pics []image.Image) []combiner.Layer {
+	layers := make([]combiner.Layer, len(imageFiles))
+	for i, imageFile := range imageFiles {
+		layers[i] = combiner.Layer{
+			Image: pics[i],
+			Tint:  imageFile.colorValue,
+			Mode:  imageFile.blendMode,
+		}
+	}
+	return layers
 }
 
-func convertToFloatColor(c color.Color) floatColor {
-	tryResult, ok := c.(floatColor)
-	if ok {
-		return tryResult
+func combineImages(imageFiles []imageInput,
+	luminance combiner.LuminanceMode) (image.Image, error) {
+	fmt.Printf("Decoding %d image(s)...\n", len(imageFiles))
+	pics, e := decodeImageFiles(imageFiles)
+	if e != nil {
+		return nil, fmt.Errorf("Failed decoding input images: %s", e)
 	}
-	r, g, b, _ := c.RGBA()
-	return floatColor{
-		r: float32(r) / 0xffff,
-		g: float32(g) / 0xffff,
-		b: float32(b) / 0xffff,
+	w, h := getMaxDimensions(pics)
+	fmt.Printf("Combining images into a %dx%d image.\n", w, h)
+	for _, imageFile := range imageFiles {
+		fmt.Printf("Setting color %s using %s...\n", imageFile.colorValue,
+			imageFile.filename)
 	}
+	outputImage, e := combiner.Combine(buildLayers(imageFiles, pics),
+		combiner.Options{Luminance: luminance})
+	if e != nil {
+		return nil, fmt.Errorf("Failed combining images: %s", e)
+	}
+	return outputImage, nil
 }
 
-type floatColorImage struct {
-	pixels []floatColor
-	w, h   int
-}
+// Controls how an animated input that runs out of frames before the other
+// inputs is extended to fill out the remaining output frames.
+type loopMode int
 
-func (f *floatColorImage) Bounds() image.Rectangle {
-	return image.Rect(0, 0, f.w, f.h)
-}
-
-func (f *floatColorImage) ColorModel() color.Model {
-	return color.ModelFunc(func(c color.Color) color.Color {
-		return convertToFloatColor(c)
-	})
-}
+const (
+	// Repeats the input's last frame for the remainder of the output.
+	holdLastFrame loopMode = iota
+	// Starts the input's frames over from the beginning.
+	loopFrames
+)
 
-func (f *floatColorImage) At(x, y int) color.Color {
-	if (x < 0) || (y < 0) || (x >= f.w) || (y >= f.h) {
-		return color.Black
+// Parses the --loop flag value. Returns an error if the string doesn't match
+// one of the supported mode names.
+func parseLoopMode(value string) (loopMode, error) {
+	switch strings.ToLower(value) {
+	case "hold":
+		return holdLastFrame, nil
+	case "loop":
+		return loopFrames, nil
 	}
-	return f.pixels[(y*f.w)+x]
+	return holdLastFrame, fmt.Errorf("Unknown loop mode %q; must be either "+
+		"\"hold\" or \"loop\"", value)
 }
 
-func (f *floatColorImage) Add(x, y int, toAdd color.Color) {
-	if (x < 0) || (y < 0) || (x >= f.w) || (y >= f.h) {
-		return
-	}
-	pixel := f.pixels[(y*f.w)+x]
-	f.pixels[(y*f.w)+x] = pixel.Add(toAdd)
+// Holds the fully-composited frames of a single input image. For a static
+// (non-animated) input, this only ever contains a single frame.
+type animatedInput struct {
+	frames []image.Image
+	// The delay of each frame, in hundredths of a second, as used by the GIF
+	// format. Always contains a single entry for static inputs.
+	delays []int
 }
 
-func newFloatColorImage(w, h int) (*floatColorImage, error) {
-	if (w <= 0) || (h <= 0) {
-		return nil, fmt.Errorf("Image bounds must be positive")
-	}
-	return &floatColorImage{
-		w:      w,
-		h:      h,
-		pixels: make([]floatColor, w*h),
-	}, nil
-}
+// The default delay, in hundredths of a second, used for a frame taken from
+// a non-animated input when it's combined alongside animated GIF inputs.
+const defaultFrameDelay = 10
 
-func parse24BitColor(value string) (floatColor, error) {
-	parsed, e := strconv.ParseUint(value, 16, 32)
+// Returns true if the given filename has a ".gif" extension and its content
+// contains more than one frame.
+func isAnimatedGIF(filename string) (bool, error) {
+	if !strings.HasSuffix(strings.ToLower(filename), ".gif") {
+		return false, nil
+	}
+	f, e := os.Open(filename)
 	if e != nil {
-		return floatColor{}, fmt.Errorf("Couldn't parse color %s: %s", value,
-			e)
+		return false, fmt.Errorf("Failed opening %s: %s", filename, e)
 	}
-	return floatColor{
-		r: float32((parsed>>16)&0xff) / 255.0,
-		g: float32((parsed>>8)&0xff) / 255.0,
-		b: float32(parsed&0xff) / 255.0,
-	}, nil
-}
-
-func parse48BitColor(value string) (floatColor, error) {
-	parsed, e := strconv.ParseUint(value, 16, 64)
+	defer f.Close()
+	g, e := gif.DecodeAll(f)
 	if e != nil {
-		return floatColor{}, fmt.Errorf("Couldn't parse color %s: %s", value,
-			e)
+		return false, fmt.Errorf("Failed decoding GIF %s: %s", filename, e)
 	}
-	return floatColor{
-		r: float32((parsed>>32)&0xffff) / 65535.0,
-		g: float32((parsed>>16)&0xffff) / 65535.0,
-		b: float32(parsed&0xffff) / 65535.0,
-	}, nil
+	return len(g.Image) > 1, nil
 }
 
-// Attempts to parse a color using an SVG color name. Returns false if a color
-// with the given name wasn't found.
-func parseNamedColor(name string) (floatColor, bool) {
-	name = strings.ToLower(name)
-	namedColor := colornames.Map[name]
-	// Since a map returns a zero-value if the key doesn't exist, and no
-	// visible will have a zero alpha value, we use an alpha value of zero to
-	// detect that the given name wasn't in the colornames map.
-	_, _, _, a := namedColor.RGBA()
-	if a == 0 {
-		return convertToFloatColor(namedColor), false
-	}
-	return convertToFloatColor(namedColor), true
+// Decodes every frame of an animated GIF, compositing each frame over the
+// previous ones (GIF frames are typically partial updates to the canvas),
+// and returns the fully-rendered result for each frame.
+func decodeGIFFrames(filename string) (*animatedInput, error) {
+	f, e := os.Open(filename)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s: %s", filename, e)
+	}
+	defer f.Close()
+	g, e := gif.DecodeAll(f)
+	if e != nil {
+		return nil, fmt.Errorf("Failed decoding GIF %s: %s", filename, e)
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	toReturn := &animatedInput{
+		frames: make([]image.Image, len(g.Image)),
+		delays: g.Delay,
+	}
+	var previousCanvas *image.RGBA
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previousCanvas = image.NewRGBA(canvas.Bounds())
+			draw.Draw(previousCanvas, previousCanvas.Bounds(), canvas,
+				image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min,
+			draw.Over)
+		frameCopy := image.NewRGBA(canvas.Bounds())
+		draw.Draw(frameCopy, frameCopy.Bounds(), canvas, image.Point{},
+			draw.Src)
+		toReturn.frames[i] = frameCopy
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent,
+				image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			if previousCanvas != nil {
+				draw.Draw(canvas, canvas.Bounds(), previousCanvas,
+					image.Point{}, draw.Src)
+			}
+		}
+	}
+	return toReturn, nil
 }
 
-// Parses an input hex string with either 24-bit or 48-bit RGB color as a float
-// color. Returns an error if the input value is invalid.
-func parseFloatColor(value string) (floatColor, error) {
-	// First check if a named color was given.
-	namedColor, nameOK := parseNamedColor(value)
-	if nameOK {
-		return namedColor, nil
-	}
-	// Allow hex color values starting with a single '#'
-	value = strings.TrimPrefix(value, "#")
-	if len(value) == 6 {
-		return parse24BitColor(value)
-	}
-	if len(value) == 12 {
-		return parse48BitColor(value)
-	}
-	return floatColor{}, fmt.Errorf("Need a 24- or 48-bit RGB color, got %s",
-		value)
+// Decodes a single, non-animated image as a one-frame animatedInput, so it
+// can be combined uniformly alongside animated GIF inputs.
+func decodeStaticFrame(filename string) (*animatedInput, error) {
+	f, e := os.Open(filename)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s: %s", filename, e)
+	}
+	defer f.Close()
+	pic, _, e := image.Decode(f)
+	if e != nil {
+		return nil, fmt.Errorf("Failed decoding image %s: %s", filename, e)
+	}
+	return &animatedInput{
+		frames: []image.Image{pic},
+		delays: []int{defaultFrameDelay},
+	}, nil
 }
 
-// This contains a filename and parsed color value, parsed from the command
-// line arguments.
-type imageInput struct {
-	filename   string
-	colorValue floatColor
+// Returns the frame at the given index, extending inputs that have fewer
+// frames than the output according to the given loop mode.
+func (a *animatedInput) frameAt(index int, loop loopMode) (image.Image, int) {
+	if index < len(a.frames) {
+		return a.frames[index], a.delays[index]
+	}
+	if loop == loopFrames {
+		index = index % len(a.frames)
+		return a.frames[index], a.delays[index]
+	}
+	last := len(a.frames) - 1
+	return a.frames[last], a.delays[last]
 }
 
-// Converts a given arbitrary RGB color to a single brightness value.
-func convertToBrightness(c color.Color) float32 {
-	r, g, b, _ := c.RGBA()
-	return float32(r+g+b) / (3.0 * 65535.0)
+// Quantizes an image down to Plan9's 256-color palette, using Floyd-
+// Steinberg dithering to preserve the appearance of gradients that the
+// palette can't represent exactly.
+func quantizeFrame(src image.Image) *image.Paletted {
+	bounds := src.Bounds()
+	dst := image.NewPaletted(bounds, palette.Plan9)
+	draw.FloydSteinberg.Draw(dst, bounds, src, bounds.Min)
+	return dst
 }
 
-// Takes 3 image filenames and returns the maximum dimensions of all of them.
-func getMaxDimensions(imageFiles []imageInput) (int, int, error) {
-	var maxW, maxH, w, h int
-	var pic image.Image
-	var e error
-	var f *os.File
-	for _, inputPic := range imageFiles {
-		filename := inputPic.filename
-		fmt.Printf("Getting dimensions for %s...\n", filename)
-		f, e = os.Open(filename)
+// Like combineImages, but supports animated GIF inputs. Each output frame is
+// the combination of the corresponding frame from every input; inputs with
+// fewer frames than the longest input are extended according to loop.
+func combineAnimatedImages(imageFiles []imageInput,
+	luminance combiner.LuminanceMode, loop loopMode) (*gif.GIF, error) {
+	inputs := make([]*animatedInput, len(imageFiles))
+	var maxW, maxH, numFrames int
+	for i, imageFile := range imageFiles {
+		animated, e := isAnimatedGIF(imageFile.filename)
 		if e != nil {
-			return 0, 0, fmt.Errorf("Failed opening %s: %s", filename, e)
+			return nil, fmt.Errorf("Failed checking %s for animation: %s",
+				imageFile.filename, e)
+		}
+		var input *animatedInput
+		if animated {
+			input, e = decodeGIFFrames(imageFile.filename)
+		} else {
+			input, e = decodeStaticFrame(imageFile.filename)
 		}
-		pic, _, e = image.Decode(f)
 		if e != nil {
-			f.Close()
-			return 0, 0, fmt.Errorf("Failed decoding %s: %s", filename, e)
+			return nil, e
+		}
+		inputs[i] = input
+		bounds := input.frames[0].Bounds()
+		if bounds.Dx() > maxW {
+			maxW = bounds.Dx()
+		}
+		if bounds.Dy() > maxH {
+			maxH = bounds.Dy()
+		}
+		if len(input.frames) > numFrames {
+			numFrames = len(input.frames)
 		}
-		w = pic.Bounds().Dx()
-		h = pic.Bounds().Dy()
-		pic = nil
-		f.Close()
-		if w > maxW {
-			maxW = w
+	}
+	fmt.Printf("Combining images into a %dx%d, %d-frame animated GIF.\n",
+		maxW, maxH, numFrames)
+	output := &gif.GIF{}
+	for frameIndex := 0; frameIndex < numFrames; frameIndex++ {
+		frames := make([]image.Image, len(inputs))
+		// Use the longest of the inputs' delays for this frame, so static
+		// inputs (which report defaultFrameDelay) set a floor without
+		// inflating the delay of frames built entirely from faster-playing
+		// animated inputs.
+		var delay int
+		for i, input := range inputs {
+			frame, frameDelay := input.frameAt(frameIndex, loop)
+			frames[i] = frame
+			if i == 0 || frameDelay > delay {
+				delay = frameDelay
+			}
 		}
-		if h > maxH {
-			maxH = h
+		combined, e := combiner.Combine(buildLayers(imageFiles, frames),
+			combiner.Options{Luminance: luminance})
+		if e != nil {
+			return nil, fmt.Errorf("Failed combining frame %d: %s",
+				frameIndex, e)
 		}
+		output.Image = append(output.Image, quantizeFrame(combined))
+		output.Delay = append(output.Delay, delay)
 	}
-	return maxW, maxH, nil
+	return output, nil
 }
 
-func addColor(dest *floatColorImage, pic image.Image, addColor floatColor) {
-	w := pic.Bounds().Dx()
-	h := pic.Bounds().Dy()
-	var scale float32
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			scale = convertToBrightness(pic.At(x, y))
-			dest.Add(x, y, addColor.Scale(scale))
+// Converts an arbitrary image to a 16-bit-per-channel NRGBA64 image. Used for
+// PNG output so the combined image's full 48-bit color precision survives
+// encoding, rather than being rounded down to 8 bits per channel first.
+func toNRGBA64(img image.Image) *image.NRGBA64 {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			dst.SetNRGBA64(x, y, c)
 		}
 	}
+	return dst
 }
 
-func combineImages(imageFiles []imageInput) (image.Image, error) {
-	var pic image.Image
-	var f *os.File
-	w, h, e := getMaxDimensions(imageFiles)
-	if e != nil {
-		return nil, fmt.Errorf("Failed getting image dimensions: %s", e)
-	}
-	fmt.Printf("Combining images into a %dx%d image.\n", w, h)
-	combined, e := newFloatColorImage(w, h)
-	if e != nil {
-		return nil, fmt.Errorf("Failed creating new image: %s", e)
-	}
-	for _, imageFile := range imageFiles {
-		fmt.Printf("Setting color %s using %s...\n", imageFile.colorValue,
-			imageFile.filename)
-		f, e = os.Open(imageFile.filename)
-		if e != nil {
-			return nil, fmt.Errorf("Failed opening file %s: %s", imageFile, e)
-		}
-		pic, _, e = image.Decode(f)
-		if e != nil {
-			f.Close()
-			return nil, fmt.Errorf("Failed decoding image %s: %s", imageFile,
-				e)
-		}
-		addColor(combined, pic, imageFile.colorValue)
-		pic = nil
-		f.Close()
+// Encodes the combined output image to f, selecting a format based on the
+// output filename's extension. Returns an error if the extension isn't one
+// of the supported output formats.
+func encodeOutput(f *os.File, outputName string, img image.Image,
+	opts runOptions) error {
+	switch strings.ToLower(filepath.Ext(outputName)) {
+	case ".png":
+		encoder := png.Encoder{CompressionLevel: opts.pngCompression}
+		return encoder.Encode(f, toNRGBA64(img))
+	case ".ppm":
+		return netpbm.Encode(f, img, &netpbm.EncodeOptions{Format: netpbm.PPM})
+	case ".pgm":
+		return netpbm.Encode(f, img, &netpbm.EncodeOptions{Format: netpbm.PGM})
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(f, img, &jpeg.Options{Quality: opts.jpegQuality})
+	case ".gif":
+		return gif.Encode(f, quantizeFrame(img), nil)
 	}
-	return combined, nil
+	return fmt.Errorf("Unsupported output file extension for %s", outputName)
 }
 
 func printUsage() {
-	fmt.Printf("Usage: %s <image 1 path> <image 1 color> <image 2> "+
+	fmt.Printf("Usage: %s [--luminance=average|wcag|rec709] "+
+		"[--loop=hold|loop] <image 1 path> <image 1 color> <image 2> "+
 		"<image 2 color> ... <output filename.jpg>\n\n"+
-		"The image colors may an SVG color name, 6 hex digits, or 12 hex "+
-		"digits (for 48-bit color).\n", os.Args[0])
+		"Each image color may be an SVG color name, 6 hex digits, or 12 "+
+		"hex digits (for 48-bit color), optionally followed by "+
+		"\":<blend mode>\" (e.g. \"ff0000:screen\"). The supported blend "+
+		"modes are \"add\" (the default), \"screen\", \"multiply\", "+
+		"\"lighten\", \"darken\", and \"over\".\n\n"+
+		"The --luminance flag selects the formula used to convert each "+
+		"source pixel to a brightness value; it defaults to \"average\". "+
+		"\"wcag\" uses the WCAG 2.1 relative luminance formula for "+
+		"perceptually accurate tinting.\n\n"+
+		"If any input is an animated GIF and the output filename ends in "+
+		"\".gif\", the output will be an animated GIF combining each input "+
+		"frame-by-frame. The --loop flag controls how inputs with fewer "+
+		"frames than the longest input are extended: \"hold\" (the "+
+		"default) repeats the input's last frame, while \"loop\" starts "+
+		"the input over from its first frame.\n\n"+
+		"The output format is selected using the output filename's "+
+		"extension: \".png\" (16-bit per channel), \".ppm\"/\".pgm\", "+
+		"\".jpg\"/\".jpeg\", or \".gif\". The --quality flag (1-100) sets "+
+		"the JPEG quality, and defaults to 100. The --png-compression "+
+		"flag sets the PNG compression level (\"default\", \"none\", "+
+		"\"speed\", or \"size\"), and defaults to \"default\".\n",
+		os.Args[0])
+}
+
+// Bundles the flags that control how images are combined and encoded,
+// separately from the positional image/color/output arguments.
+type runOptions struct {
+	luminance      combiner.LuminanceMode
+	loop           loopMode
+	jpegQuality    int
+	pngCompression png.CompressionLevel
+}
+
+func defaultRunOptions() runOptions {
+	return runOptions{
+		luminance:      combiner.LuminanceAverage,
+		loop:           holdLastFrame,
+		jpegQuality:    100,
+		pngCompression: png.DefaultCompression,
+	}
+}
+
+// Parses the --png-compression flag value.
+func parsePNGCompression(value string) (png.CompressionLevel, error) {
+	switch strings.ToLower(value) {
+	case "default":
+		return png.DefaultCompression, nil
+	case "none":
+		return png.NoCompression, nil
+	case "speed":
+		return png.BestSpeed, nil
+	case "size":
+		return png.BestCompression, nil
+	}
+	return png.DefaultCompression, fmt.Errorf("Unknown PNG compression "+
+		"level %q; must be one of \"default\", \"none\", \"speed\", or "+
+		"\"size\"", value)
+}
+
+// Parses a single "--flag=value" argument, updating opts in place. Returns
+// whether the argument was recognized as a flag, and an error if its value
+// was invalid.
+func parseFlagArgument(arg string, opts *runOptions) (bool, error) {
+	var e error
+	switch {
+	case strings.HasPrefix(arg, "--luminance="):
+		opts.luminance, e = combiner.ParseLuminanceMode(strings.TrimPrefix(arg,
+			"--luminance="))
+	case strings.HasPrefix(arg, "--loop="):
+		opts.loop, e = parseLoopMode(strings.TrimPrefix(arg, "--loop="))
+	case strings.HasPrefix(arg, "--quality="):
+		opts.jpegQuality, e = strconv.Atoi(strings.TrimPrefix(arg,
+			"--quality="))
+		if e == nil && ((opts.jpegQuality < 1) || (opts.jpegQuality > 100)) {
+			e = fmt.Errorf("quality must be between 1 and 100")
+		}
+	case strings.HasPrefix(arg, "--png-compression="):
+		opts.pngCompression, e = parsePNGCompression(strings.TrimPrefix(arg,
+			"--png-compression="))
+	default:
+		return false, nil
+	}
+	return true, e
 }
 
 // Parses the command line arguments. Returns an error if the arguments are
 // invalid for any reason. Returns a slice of input images and colors, the
-// output filename, or an error if one occurs.
-func parseArguments() ([]imageInput, string, error) {
+// output filename, the selected options, or an error if one occurs.
+func parseArguments() ([]imageInput, string, runOptions, error) {
 	var e error
-	if len(os.Args) <= 2 {
-		return nil, "", fmt.Errorf("Invalid arguments: at least one " +
-			"image/color must be provided")
-	}
-	if (len(os.Args) % 2) != 0 {
-		return nil, "", fmt.Errorf("Invalid arguments: each image must have " +
-			"a corresponding color")
-	}
-	outputName := os.Args[len(os.Args)-1]
-	// Subtract the program name and output filename from the args array to get
-	// the number of image and color arguments. Divide by 2 to get # of pairs.
-	toReturn := make([]imageInput, (len(os.Args)-2)/2)
-	var parsedColor floatColor
+	var isFlag bool
+	opts := defaultRunOptions()
+	args := os.Args[1:]
+	for (len(args) > 0) && strings.HasPrefix(args[0], "--") {
+		isFlag, e = parseFlagArgument(args[0], &opts)
+		if !isFlag {
+			break
+		}
+		if e != nil {
+			return nil, "", opts, fmt.Errorf("Invalid flag %q: %s", args[0],
+				e)
+		}
+		args = args[1:]
+	}
+	if len(args) <= 1 {
+		return nil, "", opts, fmt.Errorf("Invalid arguments: at " +
+			"least one image/color must be provided")
+	}
+	// args no longer includes the program name, so a valid image/color list
+	// plus a trailing output name is an odd count, not an even one.
+	if (len(args) % 2) != 1 {
+		return nil, "", opts, fmt.Errorf("Invalid arguments: each " +
+			"image must have a corresponding color")
+	}
+	outputName := args[len(args)-1]
+	// Subtract the output filename from the args slice to get the number of
+	// image and color arguments. Divide by 2 to get # of pairs.
+	toReturn := make([]imageInput, (len(args)-1)/2)
+	var parsedColor color.Color
+	var parsedMode combiner.BlendMode
 	for i := range toReturn {
-		toReturn[i].filename = os.Args[(i*2)+1]
-		parsedColor, e = parseFloatColor(os.Args[(i*2)+2])
+		toReturn[i].filename = args[i*2]
+		parsedColor, parsedMode, e = parseColorSpec(args[(i*2)+1])
 		if e != nil {
-			return nil, "", fmt.Errorf("Invalid color for image %s: %s",
-				toReturn[i].filename, e)
+			return nil, "", opts, fmt.Errorf(
+				"Invalid color for image %s: %s", toReturn[i].filename, e)
 		}
 		toReturn[i].colorValue = parsedColor
+		toReturn[i].blendMode = parsedMode
+	}
+	return toReturn, outputName, opts, nil
+}
+
+// Returns true if any of the given inputs is an animated GIF.
+func anyAnimatedGIF(imageFiles []imageInput) (bool, error) {
+	for _, imageFile := range imageFiles {
+		animated, e := isAnimatedGIF(imageFile.filename)
+		if e != nil {
+			return false, e
+		}
+		if animated {
+			return true, nil
+		}
 	}
-	return toReturn, outputName, nil
+	return false, nil
+}
+
+func runAnimated(toCombine []imageInput, outputName string,
+	opts runOptions) int {
+	outputGIF, e := combineAnimatedImages(toCombine, opts.luminance, opts.loop)
+	if e != nil {
+		fmt.Printf("Error combining animated images: %s\n", e)
+		return 1
+	}
+	outputFile, e := os.Create(outputName)
+	if e != nil {
+		fmt.Printf("Error opening output file: %s\n", e)
+		return 1
+	}
+	defer outputFile.Close()
+	e = gif.EncodeAll(outputFile, outputGIF)
+	if e != nil {
+		fmt.Printf("Failed creating output GIF image: %s\n", e)
+		return 1
+	}
+	return 0
 }
 
 func run() int {
-	toCombine, outputName, e := parseArguments()
+	toCombine, outputName, opts, e := parseArguments()
 	if e != nil {
 		fmt.Printf("Failed parsing arguments: %s\n", e)
 		printUsage()
 		return 1
 	}
-	outputImage, e := combineImages(toCombine)
+	if strings.HasSuffix(strings.ToLower(outputName), ".gif") {
+		hasAnimatedInput, e := anyAnimatedGIF(toCombine)
+		if e != nil {
+			fmt.Printf("Error checking inputs for animation: %s\n", e)
+			return 1
+		}
+		if hasAnimatedInput {
+			return runAnimated(toCombine, outputName, opts)
+		}
+	}
+	outputImage, e := combineImages(toCombine, opts.luminance)
 	if e != nil {
 		fmt.Printf("Error combining images: %s\n", e)
 		return 1
@@ -337,12 +585,9 @@ func run() int {
 		return 1
 	}
 	defer outputFile.Close()
-	options := jpeg.Options{
-		Quality: 100,
-	}
-	e = jpeg.Encode(outputFile, outputImage, &options)
+	e = encodeOutput(outputFile, outputName, outputImage, opts)
 	if e != nil {
-		fmt.Printf("Failed creating output JPEG image: %s\n", e)
+		fmt.Printf("Failed creating output image: %s\n", e)
 		return 1
 	}
 	return 0